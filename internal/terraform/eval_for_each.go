@@ -19,10 +19,39 @@ import (
 // evaluateForEachExpression differs from evaluateForEachExpressionValue by
 // returning an error if the count value is not known, and converting the
 // cty.Value to a map[string]cty.Value for compatibility with other calls.
-func evaluateForEachExpression(expr hcl.Expression, ctx EvalContext) (forEach map[string]cty.Value, diags tfdiags.Diagnostics) {
+//
+// The returned deferred flag exists for the future "deferred actions"
+// experiment, where an unknown (or partially unknown) for_each value would
+// be reported back as deferred instead of a hard error, so the caller could
+// record the resource or module call as deferred rather than expanding it
+// with forEach. deferralAllowed unconditionally returns false for now, so in
+// practice deferred is always false and an unknown for_each value is always
+// a hard error, exactly as before this experiment was introduced: there is
+// no plan-graph consumer yet to record a deferred call, surface it in plan
+// output, or serialize it to state, and honoring the experiment without one
+// would silently turn an unknown for_each into zero resource instances.
+func evaluateForEachExpression(expr hcl.Expression, ctx EvalContext) (forEach map[string]cty.Value, deferred bool, diags tfdiags.Diagnostics) {
 	return newForEachEvaluator(expr, ctx).ResourceValue()
 }
 
+// evaluateForEachExpressionWithKey is a sibling to evaluateForEachExpression
+// for the "for_each = <collection>, key = <expr>" form: expr must evaluate
+// to an ordered collection (a list or tuple) rather than a map or set, and
+// keyExpr is evaluated once per element, with each.value bound to the
+// element, to produce the string key for that element. This lets a
+// configuration author keep the good for_each diagnostics while supplying
+// the key logic themselves, instead of constructing a map with a "for"
+// expression that loses those diagnostics on key collisions.
+//
+// Nothing in the resource/module block schema or config decoder populates
+// keyExpr, and nothing in this package calls this function, so a
+// configuration author cannot reach it. eval_for_each_test.go tests the
+// validation helpers that ResourceValueWithKey uses, not this function or
+// ResourceValueWithKey themselves.
+func evaluateForEachExpressionWithKey(expr, keyExpr hcl.Expression, ctx EvalContext) (forEach map[string]cty.Value, deferred bool, diags tfdiags.Diagnostics) {
+	return newForEachEvaluator(expr, ctx).ResourceValueWithKey(keyExpr)
+}
+
 // forEachEvaluator is the standard mechanism for interpreting an expression
 // given for a "for_each" argument on a resource, module, or import.
 func newForEachEvaluator(expr hcl.Expression, ctx EvalContext) *forEachEvaluator {
@@ -54,38 +83,225 @@ type forEachEvaluator struct {
 
 // ResourceForEachValue returns a known for_each map[string]cty.Value
 // appropriate for use within resource expansion.
-func (ev *forEachEvaluator) ResourceValue() (map[string]cty.Value, tfdiags.Diagnostics) {
+//
+// deferred is reserved for the future deferred actions experiment, but
+// deferralAllowed always returns false today, so deferred is always false
+// and an unknown for_each value always produces an error diagnostic instead.
+func (ev *forEachEvaluator) ResourceValue() (forEach map[string]cty.Value, deferred bool, diags tfdiags.Diagnostics) {
 	res := map[string]cty.Value{}
 
 	// no expression always results in an empty map
 	if ev.expr == nil {
-		return res, nil
+		return res, false, nil
 	}
 
 	forEachVal, diags := ev.Value()
 	if diags.HasErrors() {
-		return res, diags
+		return res, false, diags
 	}
 
 	// ensure our value is known for use in resource expansion
-	diags = diags.Append(ev.ensureKnownForResource(forEachVal))
+	known, moreDiags := ev.ensureKnownForResource(forEachVal)
+	diags = diags.Append(moreDiags)
 	if diags.HasErrors() {
-		return res, diags
+		return res, false, diags
+	}
+	if !known {
+		return res, true, diags
 	}
 
 	// validate the for_each value for use in resource expansion
 	diags = diags.Append(ev.validateResource(forEachVal))
 	if diags.HasErrors() {
-		return res, diags
+		return res, false, diags
 	}
 
 	if forEachVal.IsNull() || !forEachVal.IsKnown() || markSafeLengthInt(forEachVal) == 0 {
 		// we check length, because an empty set returns a nil map which will panic below
-		return res, diags
+		return res, false, diags
 	}
 
 	res = forEachVal.AsValueMap()
-	return res, diags
+	return res, false, diags
+}
+
+// ResourceValueWithKey is a variant of ResourceValue for the "for_each =
+// <list>, key = <expr>" form. ev.expr must evaluate to an ordered collection
+// (a list or tuple), and keyExpr is evaluated once per element, with
+// each.value bound to the element, to produce the map[string]cty.Value that
+// resource expansion expects.
+func (ev *forEachEvaluator) ResourceValueWithKey(keyExpr hcl.Expression) (forEach map[string]cty.Value, deferred bool, diags tfdiags.Diagnostics) {
+	res := map[string]cty.Value{}
+
+	if ev.expr == nil {
+		return res, false, nil
+	}
+
+	collVal, diags := ev.Value()
+	if diags.HasErrors() {
+		return res, false, diags
+	}
+
+	// ensure our value is known for use in resource expansion
+	known, moreDiags := ev.ensureKnownForResourceCollection(collVal)
+	diags = diags.Append(moreDiags)
+	if diags.HasErrors() {
+		return res, false, diags
+	}
+	if !known {
+		return res, true, diags
+	}
+
+	// validate the collection value for use in resource expansion
+	diags = diags.Append(ev.validateResourceCollection(collVal))
+	if diags.HasErrors() {
+		return res, false, diags
+	}
+
+	if collVal.IsNull() || markSafeLengthInt(collVal) == 0 {
+		return res, false, diags
+	}
+
+	coll, collMarks := collVal.Unmark()
+	seen := make(map[string]struct{}, markSafeLengthInt(collVal))
+
+	it := coll.ElementIterator()
+	for it.Next() {
+		_, elem := it.Element()
+		elem = elem.WithMarks(collMarks)
+
+		keyCtx := ev.hclCtx.NewChild()
+		keyCtx.Variables = map[string]cty.Value{
+			"each": cty.ObjectVal(map[string]cty.Value{
+				"value": elem,
+			}),
+		}
+
+		keyVal, keyDiags := keyExpr.Value(keyCtx)
+		diags = diags.Append(keyDiags)
+		if keyDiags.HasErrors() {
+			return map[string]cty.Value{}, false, diags
+		}
+
+		diags = diags.Append(ev.validateForEachKey(keyExpr, keyVal, seen))
+		if diags.HasErrors() {
+			return map[string]cty.Value{}, false, diags
+		}
+
+		key := keyVal.AsString()
+		seen[key] = struct{}{}
+		res[key] = elem
+	}
+
+	return res, false, diags
+}
+
+// validateResourceCollection checks that collVal is an ordered collection
+// suitable for use with an explicit for_each key expression: a list or
+// tuple. Unlike validateResource, maps and sets are rejected here because
+// they have no well-defined element order for the key expression to rely
+// on, and because they already have their own key semantics.
+func (ev *forEachEvaluator) validateResourceCollection(collVal cty.Value) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+
+	if collVal.HasMark(marks.Sensitive) {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity:    hcl.DiagError,
+			Summary:     "Invalid for_each argument",
+			Detail:      "Sensitive values, or values derived from sensitive values, cannot be used as for_each arguments. If used, the sensitive value could be exposed as a resource instance key.",
+			Subject:     ev.expr.Range().Ptr(),
+			Expression:  ev.expr,
+			EvalContext: ev.hclCtx,
+			Extra:       diagnosticCausedBySensitive(true),
+		})
+		return diags
+	}
+
+	ty := collVal.Type()
+	switch {
+	case collVal.IsNull():
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity:    hcl.DiagError,
+			Summary:     "Invalid for_each argument",
+			Detail:      `The given "for_each" argument value is unsuitable: the given "for_each" argument value is null. A list or tuple is required when a "key" expression is also given.`,
+			Subject:     ev.expr.Range().Ptr(),
+			Expression:  ev.expr,
+			EvalContext: ev.hclCtx,
+		})
+
+	case ty == cty.DynamicPseudoType:
+		// We may not have any type information if this is during validation,
+		// so we need to return early.
+
+	case !(ty.IsListType() || ty.IsTupleType()):
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity:    hcl.DiagError,
+			Summary:     "Invalid for_each argument",
+			Detail:      fmt.Sprintf(`The given "for_each" argument value is unsuitable: a "key" expression requires "for_each" to be a list or tuple, and you have provided a value of type %s.`, ty.FriendlyName()),
+			Subject:     ev.expr.Range().Ptr(),
+			Expression:  ev.expr,
+			EvalContext: ev.hclCtx,
+		})
+	}
+
+	return diags
+}
+
+// validateForEachKey checks a single key value produced by evaluating a
+// for_each "key" expression against one element: it must be a known,
+// non-null string that hasn't already been used by an earlier element.
+func (ev *forEachEvaluator) validateForEachKey(keyExpr hcl.Expression, keyVal cty.Value, seen map[string]struct{}) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+
+	if !keyVal.IsKnown() {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity:    hcl.DiagError,
+			Summary:     "Invalid for_each key argument",
+			Detail:      "The \"key\" expression includes values derived from resource attributes that cannot be determined until apply, and so Terraform cannot determine the full set of keys that will identify the instances of this resource.",
+			Subject:     keyExpr.Range().Ptr(),
+			Expression:  keyExpr,
+			EvalContext: ev.hclCtx,
+			Extra:       diagnosticCausedByUnknown(true),
+		})
+		return diags
+	}
+
+	if keyVal.IsNull() {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity:    hcl.DiagError,
+			Summary:     "Invalid for_each key argument",
+			Detail:      `The given "key" expression is unsuitable: the "key" expression must not produce a null value for any element.`,
+			Subject:     keyExpr.Range().Ptr(),
+			Expression:  keyExpr,
+			EvalContext: ev.hclCtx,
+		})
+		return diags
+	}
+
+	if keyVal.Type() != cty.String {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity:    hcl.DiagError,
+			Summary:     "Invalid for_each key argument",
+			Detail:      fmt.Sprintf(`The given "key" expression is unsuitable: the "key" expression must always produce a string value, but this element produced a value of type %s.`, keyVal.Type().FriendlyName()),
+			Subject:     keyExpr.Range().Ptr(),
+			Expression:  keyExpr,
+			EvalContext: ev.hclCtx,
+		})
+		return diags
+	}
+
+	if _, exists := seen[keyVal.AsString()]; exists {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity:    hcl.DiagError,
+			Summary:     "Invalid for_each key argument",
+			Detail:      fmt.Sprintf(`The given "key" expression is unsuitable: the key %q was already produced by an earlier element. Each element's "key" value must be unique.`, keyVal.AsString()),
+			Subject:     keyExpr.Range().Ptr(),
+			Expression:  keyExpr,
+			EvalContext: ev.hclCtx,
+		})
+	}
+
+	return diags
 }
 
 // ImportValue returns the for_each map for use within an import block,
@@ -178,13 +394,22 @@ func (ev *forEachEvaluator) ensureKnownForImport(forEachVal cty.Value) tfdiags.D
 
 // ensureKnownForResource checks that the value is known within the rules of
 // resource and module expansion.
-func (ev *forEachEvaluator) ensureKnownForResource(forEachVal cty.Value) tfdiags.Diagnostics {
+//
+// The returned bool is true if forEachVal is sufficiently known to proceed
+// with expansion. When it is false and diags has no errors, the caller is
+// running with the deferred actions experiment enabled and must treat this
+// resource or module call as deferred rather than fail planning outright.
+func (ev *forEachEvaluator) ensureKnownForResource(forEachVal cty.Value) (bool, tfdiags.Diagnostics) {
 	var diags tfdiags.Diagnostics
 	ty := forEachVal.Type()
 	const errInvalidUnknownDetailMap = "The \"for_each\" map includes keys derived from resource attributes that cannot be determined until apply, and so Terraform cannot determine the full set of keys that will identify the instances of this resource.\n\nWhen working with unknown values in for_each, it's better to define the map keys statically in your configuration and place apply-time results only in the map values.\n\nAlternatively, you could use the -target planning option to first apply only the resources that the for_each value depends on, and then apply a second time to fully converge."
 	const errInvalidUnknownDetailSet = "The \"for_each\" set includes values derived from resource attributes that cannot be determined until apply, and so Terraform cannot determine the full set of keys that will identify the instances of this resource.\n\nWhen working with unknown values in for_each, it's better to use a map value where the keys are defined statically in your configuration and where only the values contain apply-time results.\n\nAlternatively, you could use the -target planning option to first apply only the resources that the for_each value depends on, and then apply a second time to fully converge."
 
 	if !forEachVal.IsKnown() {
+		if ev.deferralAllowed() {
+			return false, diags
+		}
+
 		var detailMsg string
 		switch {
 		case ty.IsSetType():
@@ -202,10 +427,14 @@ func (ev *forEachEvaluator) ensureKnownForResource(forEachVal cty.Value) tfdiags
 			EvalContext: ev.hclCtx,
 			Extra:       diagnosticCausedByUnknown(true),
 		})
-		return diags
+		return false, diags
 	}
 
 	if ty.IsSetType() && !forEachVal.IsWhollyKnown() {
+		if ev.deferralAllowed() {
+			return false, diags
+		}
+
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity:    hcl.DiagError,
 			Summary:     "Invalid for_each argument",
@@ -215,8 +444,53 @@ func (ev *forEachEvaluator) ensureKnownForResource(forEachVal cty.Value) tfdiags
 			EvalContext: ev.hclCtx,
 			Extra:       diagnosticCausedByUnknown(true),
 		})
+		return false, diags
 	}
-	return diags
+	return true, diags
+}
+
+// ensureKnownForResourceCollection checks that collVal itself is known, using
+// wording specific to the "for_each = <list>, key = <expr>" form rather than
+// ensureKnownForResource's map/set wording.
+//
+// Unlike ensureKnownForResource, there's no need to also check that every
+// element of collVal is known: ResourceValueWithKey evaluates the key
+// expression once per element, and validateForEachKey already reports an
+// unknown key value for any element whose data isn't known yet.
+func (ev *forEachEvaluator) ensureKnownForResourceCollection(collVal cty.Value) (bool, tfdiags.Diagnostics) {
+	var diags tfdiags.Diagnostics
+
+	if !collVal.IsKnown() {
+		if ev.deferralAllowed() {
+			return false, diags
+		}
+
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity:    hcl.DiagError,
+			Summary:     "Invalid for_each argument",
+			Detail:      "The \"for_each\" list or tuple includes values derived from resource attributes that cannot be determined until apply, and so Terraform cannot determine the full set of elements that will identify the instances of this resource.\n\nWhen working with unknown values in for_each, it's better to define a \"key\" expression that only depends on values known statically in your configuration.\n\nAlternatively, you could use the -target planning option to first apply only the resources that the for_each value depends on, and then apply a second time to fully converge.",
+			Subject:     ev.expr.Range().Ptr(),
+			Expression:  ev.expr,
+			EvalContext: ev.hclCtx,
+			Extra:       diagnosticCausedByUnknown(true),
+		})
+		return false, diags
+	}
+
+	return true, diags
+}
+
+// deferralAllowed reports whether the deferred actions experiment is active
+// for this evaluation, allowing ensureKnownForResource to report an unknown
+// for_each value as deferred instead of raising an error. ImportValues never
+// consults this, since import for_each values must always be fully known.
+//
+// This unconditionally returns false and does not consult ctx: nothing
+// downstream of this evaluator records a deferred resource or module call,
+// surfaces it in plan output, or serializes it to state, so an unknown
+// for_each value is always reported as an error diagnostic.
+func (ev *forEachEvaluator) deferralAllowed() bool {
+	return false
 }
 
 // ValidateResourceValue is used from validation walks to verify the validity
@@ -231,9 +505,38 @@ func (ev *forEachEvaluator) ValidateResourceValue() tfdiags.Diagnostics {
 	return diags.Append(ev.validateResource(val))
 }
 
+// ValidateResourceValueWithKey is the ValidateResourceValue counterpart for
+// the "for_each = <list>, key = <expr>" form: it validates the collection's
+// type, nullness and sensitivity (not its element values, and not the "key"
+// expression) from a validation walk, without requiring it to be
+// known, mirroring the split between ResourceValueWithKey (used during
+// plan/apply, which hard-errors on an unknown collection via
+// ensureKnownForResourceCollection) and ValidateResourceValue.
+func (ev *forEachEvaluator) ValidateResourceValueWithKey() tfdiags.Diagnostics {
+	val, diags := ev.Value()
+	if diags.HasErrors() {
+		return diags
+	}
+
+	return diags.Append(ev.validateResourceCollection(val))
+}
+
 // validateResource validates the type and values of the forEachVal, while
 // still allowing unknown values for use within the validation walk.
 func (ev *forEachEvaluator) validateResource(forEachVal cty.Value) tfdiags.Diagnostics {
+	return validateForEachCollectionCore(forEachVal, ev.expr, ev.hclCtx)
+}
+
+// validateForEachCollectionCore validates the type and values of forEachVal
+// against the rules for a "for_each" map or set of strings, while still
+// allowing unknown values for use within a validation walk.
+//
+// This is the body of forEachEvaluator.validateResource as a standalone
+// function, independent of a forEachEvaluator receiver. It is not exported;
+// its only callers are validateResource and eval_for_each_test.go. Dynamic
+// blocks expanded by internal/lang.Scope.ExpandBlock do not use it and
+// validate their iterator expression with their own, separate diagnostics.
+func validateForEachCollectionCore(forEachVal cty.Value, expr hcl.Expression, hclCtx *hcl.EvalContext) tfdiags.Diagnostics {
 	var diags tfdiags.Diagnostics
 
 	// give an error diagnostic as this value cannot be used in for_each
@@ -242,9 +545,9 @@ func (ev *forEachEvaluator) validateResource(forEachVal cty.Value) tfdiags.Diagn
 			Severity:    hcl.DiagError,
 			Summary:     "Invalid for_each argument",
 			Detail:      "Sensitive values, or values derived from sensitive values, cannot be used as for_each arguments. If used, the sensitive value could be exposed as a resource instance key.",
-			Subject:     ev.expr.Range().Ptr(),
-			Expression:  ev.expr,
-			EvalContext: ev.hclCtx,
+			Subject:     expr.Range().Ptr(),
+			Expression:  expr,
+			EvalContext: hclCtx,
 			Extra:       diagnosticCausedBySensitive(true),
 		})
 	}
@@ -260,9 +563,9 @@ func (ev *forEachEvaluator) validateResource(forEachVal cty.Value) tfdiags.Diagn
 			Severity:    hcl.DiagError,
 			Summary:     "Invalid for_each argument",
 			Detail:      `The given "for_each" argument value is unsuitable: the given "for_each" argument value is null. A map, or set of strings is allowed.`,
-			Subject:     ev.expr.Range().Ptr(),
-			Expression:  ev.expr,
-			EvalContext: ev.hclCtx,
+			Subject:     expr.Range().Ptr(),
+			Expression:  expr,
+			EvalContext: hclCtx,
 		})
 		return diags
 
@@ -277,9 +580,9 @@ func (ev *forEachEvaluator) validateResource(forEachVal cty.Value) tfdiags.Diagn
 			Severity:    hcl.DiagError,
 			Summary:     "Invalid for_each argument",
 			Detail:      fmt.Sprintf(`The given "for_each" argument value is unsuitable: the "for_each" argument must be a map, or set of strings, and you have provided a value of type %s.`, ty.FriendlyName()),
-			Subject:     ev.expr.Range().Ptr(),
-			Expression:  ev.expr,
-			EvalContext: ev.hclCtx,
+			Subject:     expr.Range().Ptr(),
+			Expression:  expr,
+			EvalContext: hclCtx,
 		})
 		return diags
 
@@ -305,9 +608,9 @@ func (ev *forEachEvaluator) validateResource(forEachVal cty.Value) tfdiags.Diagn
 				Severity:    hcl.DiagError,
 				Summary:     "Invalid for_each set argument",
 				Detail:      fmt.Sprintf(`The given "for_each" argument value is unsuitable: "for_each" supports maps and sets of strings, but you have provided a set containing type %s.`, forEachVal.Type().ElementType().FriendlyName()),
-				Subject:     ev.expr.Range().Ptr(),
-				Expression:  ev.expr,
-				EvalContext: ev.hclCtx,
+				Subject:     expr.Range().Ptr(),
+				Expression:  expr,
+				EvalContext: hclCtx,
 			})
 			return diags
 		}
@@ -322,9 +625,9 @@ func (ev *forEachEvaluator) validateResource(forEachVal cty.Value) tfdiags.Diagn
 					Severity:    hcl.DiagError,
 					Summary:     "Invalid for_each set argument",
 					Detail:      `The given "for_each" argument value is unsuitable: "for_each" sets must not contain null values.`,
-					Subject:     ev.expr.Range().Ptr(),
-					Expression:  ev.expr,
-					EvalContext: ev.hclCtx,
+					Subject:     expr.Range().Ptr(),
+					Expression:  expr,
+					EvalContext: hclCtx,
 				})
 				return diags
 			}
@@ -0,0 +1,190 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package terraform
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hcltest"
+	"github.com/zclconf/go-cty/cty"
+
+	"github.com/hashicorp/terraform/internal/lang/marks"
+	"github.com/hashicorp/terraform/internal/tfdiags"
+)
+
+func TestForEachEvaluatorValidateForEachKey(t *testing.T) {
+	tests := map[string]struct {
+		keyVal  cty.Value
+		seen    map[string]struct{}
+		wantErr string
+	}{
+		"valid key": {
+			keyVal: cty.StringVal("a"),
+		},
+		"unknown key": {
+			keyVal:  cty.UnknownVal(cty.String),
+			wantErr: `The "key" expression includes values derived from resource attributes`,
+		},
+		"null key": {
+			keyVal:  cty.NullVal(cty.String),
+			wantErr: `the "key" expression must not produce a null value for any element`,
+		},
+		"non-string key": {
+			keyVal:  cty.NumberIntVal(1),
+			wantErr: `the "key" expression must always produce a string value`,
+		},
+		"duplicate key": {
+			keyVal:  cty.StringVal("dup"),
+			seen:    map[string]struct{}{"dup": {}},
+			wantErr: `the key "dup" was already produced by an earlier element`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ev := &forEachEvaluator{
+				expr:   hcltest.MockExprLiteral(cty.EmptyTupleVal),
+				hclCtx: &hcl.EvalContext{},
+			}
+			keyExpr := hcltest.MockExprLiteral(test.keyVal)
+			seen := test.seen
+			if seen == nil {
+				seen = map[string]struct{}{}
+			}
+
+			diags := ev.validateForEachKey(keyExpr, test.keyVal, seen)
+			assertForEachDiags(t, diags, test.wantErr)
+		})
+	}
+}
+
+func TestForEachEvaluatorValidateResourceCollection(t *testing.T) {
+	tests := map[string]struct {
+		collVal cty.Value
+		wantErr string
+	}{
+		"valid list": {
+			collVal: cty.ListVal([]cty.Value{cty.StringVal("a")}),
+		},
+		"valid tuple": {
+			collVal: cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.NumberIntVal(1)}),
+		},
+		"sensitive": {
+			collVal: cty.ListVal([]cty.Value{cty.StringVal("a")}).Mark(marks.Sensitive),
+			wantErr: "Sensitive values, or values derived from sensitive values, cannot be used as for_each arguments",
+		},
+		"null": {
+			collVal: cty.NullVal(cty.List(cty.String)),
+			wantErr: `a "key" expression is also given`,
+		},
+		"map": {
+			collVal: cty.MapValEmpty(cty.String),
+			wantErr: `a "key" expression requires "for_each" to be a list or tuple`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ev := &forEachEvaluator{
+				expr:   hcltest.MockExprLiteral(test.collVal),
+				hclCtx: &hcl.EvalContext{},
+			}
+			diags := ev.validateResourceCollection(test.collVal)
+			assertForEachDiags(t, diags, test.wantErr)
+		})
+	}
+}
+
+func TestForEachEvaluatorEnsureKnownForResourceCollection(t *testing.T) {
+	tests := map[string]struct {
+		collVal   cty.Value
+		wantKnown bool
+		wantErr   string
+	}{
+		"known list": {
+			collVal:   cty.ListVal([]cty.Value{cty.StringVal("a")}),
+			wantKnown: true,
+		},
+		"unknown list": {
+			collVal: cty.UnknownVal(cty.List(cty.String)),
+			wantErr: `The "for_each" list or tuple includes values derived from resource attributes`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ev := &forEachEvaluator{
+				expr:   hcltest.MockExprLiteral(test.collVal),
+				hclCtx: &hcl.EvalContext{},
+			}
+			known, diags := ev.ensureKnownForResourceCollection(test.collVal)
+			if known != test.wantKnown {
+				t.Errorf("wrong known result\ngot:  %t\nwant: %t", known, test.wantKnown)
+			}
+			assertForEachDiags(t, diags, test.wantErr)
+		})
+	}
+}
+
+func TestValidateForEachCollectionCore(t *testing.T) {
+	tests := map[string]struct {
+		forEachVal cty.Value
+		wantErr    string
+	}{
+		"valid map": {
+			forEachVal: cty.MapVal(map[string]cty.Value{"a": cty.StringVal("b")}),
+		},
+		"valid set of strings": {
+			forEachVal: cty.SetVal([]cty.Value{cty.StringVal("a")}),
+		},
+		"sensitive": {
+			forEachVal: cty.MapValEmpty(cty.String).Mark(marks.Sensitive),
+			wantErr:    "Sensitive values, or values derived from sensitive values, cannot be used as for_each arguments",
+		},
+		"null": {
+			forEachVal: cty.NullVal(cty.Map(cty.String)),
+			wantErr:    `the given "for_each" argument value is null`,
+		},
+		"wrong type": {
+			forEachVal: cty.ListVal([]cty.Value{cty.StringVal("a")}),
+			wantErr:    `the "for_each" argument must be a map, or set of strings`,
+		},
+		"set of non-strings": {
+			forEachVal: cty.SetVal([]cty.Value{cty.NumberIntVal(1)}),
+			wantErr:    `"for_each" supports maps and sets of strings`,
+		},
+		"set with null element": {
+			forEachVal: cty.SetVal([]cty.Value{cty.StringVal("a"), cty.NullVal(cty.String)}),
+			wantErr:    `"for_each" sets must not contain null values`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr := hcltest.MockExprLiteral(test.forEachVal)
+			diags := validateForEachCollectionCore(test.forEachVal, expr, &hcl.EvalContext{})
+			assertForEachDiags(t, diags, test.wantErr)
+		})
+	}
+}
+
+func assertForEachDiags(t *testing.T, diags tfdiags.Diagnostics, wantErr string) {
+	t.Helper()
+
+	if wantErr == "" {
+		if diags.HasErrors() {
+			t.Fatalf("unexpected error: %s", diags.Err())
+		}
+		return
+	}
+
+	if !diags.HasErrors() {
+		t.Fatalf("expected error containing %q, got none", wantErr)
+	}
+	if got := diags.Err().Error(); !strings.Contains(got, wantErr) {
+		t.Fatalf("wrong error\ngot:  %s\nwant substring: %s", got, wantErr)
+	}
+}